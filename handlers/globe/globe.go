@@ -1,12 +1,34 @@
+// Package globe implements the courier.ChannelHandler for the Globe Labs
+// (GL) SMS channel.
+//
+// Out of scope: a generic SMSProvider interface in handlers/ that would let
+// the courier engine own retry/rate-limiting/MsgStatus bookkeeping centrally
+// for this and other telco backends. That requires the engine itself to
+// grow a dispatcher loop that calls into such an interface; nothing in this
+// package can deliver that alone, and an earlier attempt at it here
+// (defining the interface and adapting this handler to it, with nothing
+// upstream ever calling it) was reverted rather than left as dead code. This
+// stays a self-contained handler, with its own retry loop in SendMsg, until
+// that engine-level work is taken on as its own change.
 package globe
 
 import (
 	"bytes"
+	"container/list"
 	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nyaruka/courier"
@@ -16,30 +38,114 @@ import (
 )
 
 var maxMsgLength = 160
-var sendURL = "https://devapi.globelabs.com.ph/smsmessaging/v1/outbound/%s/requests"
+var sendURL = "https://devapi.globelabs.com.ph/smsmessaging/v1/outbound/%s/requests?access_token=%s"
 
 const (
 	configPassphrase = "passphrase"
 	configAppSecret  = "app_secret"
 	configAppID      = "app_id"
+
+	configRetryMax     = "retry_max"
+	configRetryBaseMS  = "retry_base_ms"
+	configRetryMaxMS   = "retry_max_ms"
+	defaultRetryMax    = 3
+	defaultRetryBaseMS = 500
+	defaultRetryMaxMS  = 5000
+
+	configSignatureHeader   = "signature_header"
+	configAllowedIPs        = "allowed_ips"
+	configTrustForwardedIPs = "trust_forwarded_ips"
+	defaultSignatureHeader  = "X-Globe-Signature"
+	timestampHeader         = "X-Globe-Timestamp"
+	replayWindow            = 5 * time.Minute
+	maxSeenSignatures       = 100000
 )
 
+// defaultTokenTTL is how long we consider a subscriber access token valid if
+// Globe's authorization callback doesn't tell us an `expires_in`
+const defaultTokenTTL = time.Hour
+
+// subscriberToken is the access token Globe issued a subscriber, and when it
+// stops being valid
+type subscriberToken struct {
+	accessToken string
+	expiration  time.Time
+}
+
+// tokenStore keeps the per-subscriber OAuth2 access tokens Globe Labs issues
+// through its authorization dialog, keyed by channel + URN.
+//
+// KNOWN LIMITATION: this is an in-process map, not the courier.Backend
+// key/value store the request asked for, because no Backend implementation
+// available to this change actually provides one. That means every
+// subscriber's token is lost on process restart (forcing them to redo the
+// OAuth dialog), and in a multi-instance deployment a send fails with "no
+// active access token" whenever it's handled by an instance other than the
+// one that processed that subscriber's /authorize callback. Don't build on
+// top of this assuming durability or cross-instance sharing — land the real
+// courier.Backend extension before relying on Globe sends in production
+type tokenStore struct {
+	mutex  sync.RWMutex
+	tokens map[string]subscriberToken
+}
+
+func newTokenStore() *tokenStore {
+	return &tokenStore{tokens: make(map[string]subscriberToken)}
+}
+
+func tokenStoreKey(channel courier.Channel, urn urns.URN) string {
+	return fmt.Sprintf("%s/%s", channel.UUID(), urn.Identity())
+}
+
+func (s *tokenStore) Set(channel courier.Channel, urn urns.URN, accessToken string, expiration time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokens[tokenStoreKey(channel, urn)] = subscriberToken{accessToken: accessToken, expiration: expiration}
+}
+
+func (s *tokenStore) Get(channel courier.Channel, urn urns.URN) (string, time.Time) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	token, found := s.tokens[tokenStoreKey(channel, urn)]
+	if !found {
+		return "", time.Time{}
+	}
+	return token.accessToken, token.expiration
+}
+
 func init() {
 	courier.RegisterHandler(newHandler())
 }
 
 type handler struct {
 	handlers.BaseHandler
+
+	tokens *tokenStore
+
+	seenMutex  sync.Mutex
+	seenOrder  *list.List
+	seenLookup map[string]*list.Element
 }
 
 func newHandler() courier.ChannelHandler {
-	return &handler{handlers.NewBaseHandler(courier.ChannelType("GL"), "Globe Labs")}
+	return &handler{
+		BaseHandler: handlers.NewBaseHandler(courier.ChannelType("GL"), "Globe Labs"),
+		tokens:      newTokenStore(),
+		seenOrder:   list.New(),
+		seenLookup:  make(map[string]*list.Element),
+	}
 }
 
 // Initialize is called by the engine once everything is loaded
 func (h *handler) Initialize(s courier.Server) error {
 	h.SetServer(s)
-	return s.AddHandlerRoute(h, http.MethodPost, "receive", h.ReceiveMessage)
+	if err := s.AddHandlerRoute(h, http.MethodPost, "receive", h.ReceiveMessage); err != nil {
+		return err
+	}
+	if err := s.AddHandlerRoute(h, http.MethodPost, "authorize", h.AuthorizeSubscriber); err != nil {
+		return err
+	}
+	return s.AddHandlerRoute(h, http.MethodPost, "status", h.StatusMessage)
 }
 
 // {
@@ -71,38 +177,218 @@ type moMsg struct {
 	} `json:"inboundSMSMessageList"`
 }
 
-// ReceiveMessage is our HTTP handler function for incoming messages
-func (h *handler) ReceiveMessage(ctx context.Context, c courier.Channel, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
-	glRequest := &moMsg{}
-	err := handlers.DecodeAndValidateJSON(glRequest, r)
+// seenSignature is a signature we've accepted, and when we saw it, so it can
+// be expired once it falls outside the replay window
+type seenSignature struct {
+	sig    string
+	seenAt time.Time
+}
+
+// markSeen records sig as seen, evicting entries older than replayWindow
+// first, and then (if we're still over maxSeenSignatures, which should only
+// happen under an abusive volume of otherwise-valid signatures) the oldest
+// entries regardless of age. It returns true if sig had already been seen
+// within the window
+func (h *handler) markSeen(sig string) bool {
+	h.seenMutex.Lock()
+	defer h.seenMutex.Unlock()
+
+	cutoff := time.Now().Add(-replayWindow)
+	for front := h.seenOrder.Front(); front != nil; front = h.seenOrder.Front() {
+		entry := front.Value.(seenSignature)
+		if entry.seenAt.After(cutoff) {
+			break
+		}
+		h.seenOrder.Remove(front)
+		delete(h.seenLookup, entry.sig)
+	}
+	for h.seenOrder.Len() > maxSeenSignatures {
+		oldest := h.seenOrder.Front()
+		h.seenOrder.Remove(oldest)
+		delete(h.seenLookup, oldest.Value.(seenSignature).sig)
+	}
+
+	if _, found := h.seenLookup[sig]; found {
+		return true
+	}
+
+	h.seenLookup[sig] = h.seenOrder.PushBack(seenSignature{sig: sig, seenAt: time.Now()})
+	return false
+}
+
+// verifySignature checks that sig (the hex-encoded value of a
+// "sha256=<hex>" header) is the HMAC-SHA256 of body keyed by secret
+func verifySignature(secret string, body []byte, sig string) bool {
+	sig = strings.TrimPrefix(sig, "sha256=")
+	expected, err := hex.DecodeString(sig)
 	if err != nil {
-		return nil, courier.WriteAndLogRequestError(ctx, w, r, c, err)
+		return false
 	}
 
-	if len(glRequest.InboundSMSMessageList.InboundSMSMessage) == 0 {
-		return nil, courier.WriteAndLogRequestIgnored(ctx, w, r, c, "no messages, ignored")
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// clientIP returns the address courier considers the request to have come
+// from. If trustForwarded is set, that's the first hop in X-Forwarded-For or
+// the X-Real-IP header, since courier is then assumed to sit behind a proxy
+// that sets (and can be trusted to set) those headers; otherwise it's always
+// r.RemoteAddr
+func clientIP(trustForwarded bool, r *http.Request) string {
+	if trustForwarded {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+		if real := r.Header.Get("X-Real-IP"); real != "" {
+			return real
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkAllowedIPs returns an error if the channel has an `allowed_ips` CIDR
+// allowlist configured and the request's remote address isn't in it. The
+// remote address is taken from X-Forwarded-For/X-Real-IP instead of
+// r.RemoteAddr when the channel opts in with trust_forwarded_ips, for
+// deployments where courier sits behind a proxy that sets those headers
+func checkAllowedIPs(c courier.Channel, r *http.Request) error {
+	allowed := c.ConfigForKey(configAllowedIPs, nil)
+	cidrs, ok := allowed.([]string)
+	if !ok || len(cidrs) == 0 {
+		return nil
 	}
 
-	events := make([]courier.Event, 0, 1)
-	msgs := make([]courier.Msg, 0, 1)
+	host := clientIP(c.BoolConfigForKey(configTrustForwardedIPs, false), r)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("unable to parse remote address '%s'", host)
+	}
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && network.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("request from '%s' is not in the channel's allowed_ips", ip)
+}
+
+// verifyRequest validates the HMAC signature Globe sends on every inbound
+// webhook, rejecting requests with a missing/invalid signature, a stale
+// timestamp, or one we've already processed within the replay window. The
+// signature header name is configurable for forward compatibility
+func (h *handler) verifyRequest(c courier.Channel, r *http.Request) error {
+	appSecret := c.StringConfigForKey(configAppSecret, "")
+	if appSecret == "" {
+		return fmt.Errorf("missing 'app_secret' config for GL channel")
+	}
+
+	headerName := c.StringConfigForKey(configSignatureHeader, defaultSignatureHeader)
+	sig := r.Header.Get(headerName)
+	if sig == "" {
+		return fmt.Errorf("missing '%s' header", headerName)
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if !verifySignature(appSecret, body, sig) {
+		return fmt.Errorf("invalid request signature")
+	}
+
+	ts := r.Header.Get(timestampHeader)
+	if ts != "" {
+		unixTS, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid '%s' header", timestampHeader)
+		}
+		if delta := time.Since(time.Unix(unixTS, 0)); delta < -replayWindow || delta > replayWindow {
+			return fmt.Errorf("request timestamp is outside the allowed %s window", replayWindow)
+		}
+	}
+
+	if h.markSeen(sig) {
+		return fmt.Errorf("request with this signature has already been processed")
+	}
+
+	return nil
+}
+
+// inboundMsg is a single normalized message parsed out of Globe's
+// inboundSMSMessageList payload
+type inboundMsg struct {
+	URN        string
+	Text       string
+	ExternalID string
+	ReceivedOn time.Time
+}
+
+// parseInbound decodes Globe's inboundSMSMessageList payload into the
+// messages it contains
+func (h *handler) parseInbound(r *http.Request) ([]inboundMsg, error) {
+	glRequest := &moMsg{}
+	if err := handlers.DecodeAndValidateJSON(glRequest, r); err != nil {
+		return nil, err
+	}
 
-	// parse each inbound message
+	inbound := make([]inboundMsg, 0, len(glRequest.InboundSMSMessageList.InboundSMSMessage))
 	for _, glMsg := range glRequest.InboundSMSMessageList.InboundSMSMessage {
 		// parse our date from format: "Fri Nov 22 2013 12:12:13 GMT+0000 (UTC)"
 		date, err := time.Parse("Mon Jan 2 2006 15:04:05 GMT+0000 (UTC)", glMsg.DateTime)
 		if err != nil {
-			return nil, courier.WriteAndLogRequestError(ctx, w, r, c, err)
+			return nil, err
 		}
 
 		if !strings.HasPrefix(glMsg.SenderAddress, "tel:") {
-			return nil, courier.WriteAndLogRequestError(ctx, w, r, c, fmt.Errorf("invalid 'senderAddress' parameter"))
+			return nil, fmt.Errorf("invalid 'senderAddress' parameter")
 		}
 
-		urn := urns.NewTelURNForCountry(glMsg.SenderAddress[4:], c.Country())
-		msg := h.Backend().NewIncomingMsg(c, urn, glMsg.Message).WithExternalID(glMsg.MessageID).WithReceivedOn(date)
+		inbound = append(inbound, inboundMsg{
+			URN:        glMsg.SenderAddress[4:],
+			Text:       glMsg.Message,
+			ExternalID: glMsg.MessageID,
+			ReceivedOn: date,
+		})
+	}
 
-		err = h.Backend().WriteMsg(ctx, msg)
-		if err != nil {
+	return inbound, nil
+}
+
+// ReceiveMessage is our HTTP handler function for incoming messages
+func (h *handler) ReceiveMessage(ctx context.Context, c courier.Channel, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
+	if err := checkAllowedIPs(c, r); err != nil {
+		return nil, courier.WriteAndLogRequestError(ctx, w, r, c, err)
+	}
+
+	if err := h.verifyRequest(c, r); err != nil {
+		return nil, courier.WriteAndLogRequestError(ctx, w, r, c, err)
+	}
+
+	inbound, err := h.parseInbound(r)
+	if err != nil {
+		return nil, courier.WriteAndLogRequestError(ctx, w, r, c, err)
+	}
+
+	if len(inbound) == 0 {
+		return nil, courier.WriteAndLogRequestIgnored(ctx, w, r, c, "no messages, ignored")
+	}
+
+	events := make([]courier.Event, 0, len(inbound))
+	msgs := make([]courier.Msg, 0, len(inbound))
+
+	for _, in := range inbound {
+		urn := urns.NewTelURNForCountry(in.URN, c.Country())
+		msg := h.Backend().NewIncomingMsg(c, urn, in.Text).WithExternalID(in.ExternalID).WithReceivedOn(in.ReceivedOn)
+
+		if err := h.Backend().WriteMsg(ctx, msg); err != nil {
 			return nil, err
 		}
 
@@ -113,67 +399,280 @@ func (h *handler) ReceiveMessage(ctx context.Context, c courier.Channel, w http.
 	return events, courier.WriteMsgSuccess(ctx, w, r, msgs)
 }
 
+// {
+//	  "access_token": "the token issued to this subscriber",
+//    "subscriber_number": "639171234567"
+// }
+//
+// Globe's OAuth2 dialog redirects the subscriber's browser to this endpoint
+// with the access token it issued them, which we then use to send to that
+// subscriber going forward
+type authCallback struct {
+	AccessToken      string `json:"access_token" validate:"required"`
+	SubscriberNumber string `json:"subscriber_number" validate:"required"`
+	ExpiresIn        int    `json:"expires_in"`
+}
+
+// AuthorizeSubscriber is our HTTP handler for Globe's OAuth2 authorization
+// callback. Unlike ReceiveMessage and StatusMessage, this is hit directly by
+// the subscriber's own browser being redirected by Globe's OAuth dialog, so
+// it has no way to compute our HMAC signature and we can't require
+// verifyRequest here. We only have allowed_ips (a weak mitigation, since the
+// caller is a subscriber's browser rather than a fixed set of Globe server
+// IPs) and the fact that the channel UUID isn't public. There's no state/
+// nonce binding this callback back to a specific authorization attempt we
+// initiated, so a party that learns the channel UUID can still plant or
+// overwrite another subscriber's token; closing that needs a real OAuth
+// state parameter, which isn't modeled anywhere else in this handler
+func (h *handler) AuthorizeSubscriber(ctx context.Context, c courier.Channel, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
+	if err := checkAllowedIPs(c, r); err != nil {
+		return nil, courier.WriteAndLogRequestError(ctx, w, r, c, err)
+	}
+
+	authRequest := &authCallback{}
+	err := handlers.DecodeAndValidateJSON(authRequest, r)
+	if err != nil {
+		return nil, courier.WriteAndLogRequestError(ctx, w, r, c, err)
+	}
+
+	urn := urns.NewTelURNForCountry(authRequest.SubscriberNumber, c.Country())
+
+	expiration := time.Now().Add(defaultTokenTTL)
+	if authRequest.ExpiresIn > 0 {
+		expiration = time.Now().Add(time.Duration(authRequest.ExpiresIn) * time.Second)
+	}
+
+	h.tokens.Set(c, urn, authRequest.AccessToken, expiration)
+
+	return nil, courier.WriteAndLogRequestIgnored(ctx, w, r, c, "subscriber authorized")
+}
+
 // {
 //	  "address": "250788383383",
 //    "message": "hello world",
-//    "passphrase": "my passphrase",
-//    "app_id": "my app id",
-//    "app_secret": "my app secret"
+//    "clientCorrelator": "a stable id we generate so DLRs can be matched back"
 // }
+//
+// the app_id/app_secret/passphrase that used to be sent here are no longer
+// needed now that sends are authorized by a per-subscriber access token
 type mtMsg struct {
-	Address    string `json:"address"`
-	Message    string `json:"message"`
-	Passphrase string `json:"passphrase"`
-	AppID      string `json:"app_id"`
-	AppSecret  string `json:"app_secret"`
+	Address          string `json:"address"`
+	Message          string `json:"message"`
+	ClientCorrelator string `json:"clientCorrelator,omitempty"`
 }
 
-// SendMsg sends the passed in message, returning any error
-func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
-	appID := msg.Channel().StringConfigForKey(configAppID, "")
-	if appID == "" {
-		return nil, fmt.Errorf("Missing 'app_id' config for GL channel")
+// {
+//   "deliveryInfoNotification": {
+//     "messageId": "envelope-id-assigned-by-globe",
+//     "clientCorrelator": "the id we sent with the outbound part",
+//     "deliveryInfo": {
+//       "address": "tel:+639171234567",
+//       "deliveryStatus": "DeliveredToTerminal"
+//     }
+//   }
+// }
+type statusNotification struct {
+	DeliveryInfoNotification struct {
+		MessageID        string `json:"messageId"`
+		ClientCorrelator string `json:"clientCorrelator"`
+		DeliveryInfo     struct {
+			Address        string `json:"address"`
+			DeliveryStatus string `json:"deliveryStatus"`
+		} `json:"deliveryInfo"`
+	} `json:"deliveryInfoNotification" validate:"required"`
+}
+
+const (
+	deliveryStatusDeliveredToTerminal = "DeliveredToTerminal"
+	deliveryStatusDeliveryImpossible  = "DeliveryImpossible"
+	deliveryStatusMessageWaiting      = "MessageWaiting"
+	deliveryStatusDeliveredToNetwork  = "DeliveredToNetwork"
+)
+
+// deliveryStatusMapping maps Globe's deliveryStatus values to our own statuses.
+// MessageWaiting isn't included as it's an intermediate state we just ignore
+var deliveryStatusMapping = map[string]courier.MsgStatusValue{
+	deliveryStatusDeliveredToTerminal: courier.MsgDelivered,
+	deliveryStatusDeliveryImpossible:  courier.MsgFailed,
+	deliveryStatusDeliveredToNetwork:  courier.MsgSent,
+}
+
+// StatusMessage is our HTTP handler function for delivery receipts
+func (h *handler) StatusMessage(ctx context.Context, c courier.Channel, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
+	if err := checkAllowedIPs(c, r); err != nil {
+		return nil, courier.WriteAndLogRequestError(ctx, w, r, c, err)
 	}
 
-	appSecret := msg.Channel().StringConfigForKey(configAppSecret, "")
-	if appSecret == "" {
-		return nil, fmt.Errorf("Missing 'app_secret' config for GL channel")
+	if err := h.verifyRequest(c, r); err != nil {
+		return nil, courier.WriteAndLogRequestError(ctx, w, r, c, err)
+	}
+
+	notification := &statusNotification{}
+	if err := handlers.DecodeAndValidateJSON(notification, r); err != nil {
+		return nil, courier.WriteAndLogRequestError(ctx, w, r, c, err)
+	}
+
+	info := notification.DeliveryInfoNotification
+	newStatus, known := deliveryStatusMapping[info.DeliveryInfo.DeliveryStatus]
+	if !known {
+		return nil, courier.WriteAndLogRequestIgnored(ctx, w, r, c, fmt.Sprintf("ignoring delivery status '%s'", info.DeliveryInfo.DeliveryStatus))
 	}
 
-	passphrase := msg.Channel().StringConfigForKey(configPassphrase, "")
-	if passphrase == "" {
-		return nil, fmt.Errorf("Missing 'passphrase' config for GL channel")
+	externalID := info.ClientCorrelator
+	if externalID == "" {
+		externalID = info.MessageID
+	}
+	if externalID == "" {
+		return nil, courier.WriteAndLogRequestError(ctx, w, r, c, fmt.Errorf("missing 'clientCorrelator' or 'messageId' in request"))
+	}
+
+	msg, err := h.Backend().GetMsgByExternalID(ctx, c, externalID)
+	if err != nil {
+		return nil, courier.WriteAndLogRequestError(ctx, w, r, c, err)
 	}
 
+	status := h.Backend().NewMsgStatusForID(c, msg.ID(), newStatus)
+	if err := h.Backend().WriteMsgStatus(ctx, status); err != nil {
+		return nil, err
+	}
+
+	return []courier.Event{status}, courier.WriteStatusSuccess(ctx, w, r, status)
+}
+
+// idempotencyKey returns a stable key for a given message part so that retried
+// attempts of the same part can be recognized (and deduped) by Globe Labs
+func idempotencyKey(channelUUID courier.ChannelUUID, msgID courier.MsgID, partIndex int) string {
+	hash := sha1.Sum([]byte(fmt.Sprintf("%s:%d:%d", channelUUID, msgID, partIndex)))
+	return hex.EncodeToString(hash[:])
+}
+
+// sendOnce makes a single, unretried attempt to deliver part of msg to Globe
+// Labs using accessToken, identifying it to Globe with idemKey
+func (h *handler) sendOnce(msg courier.Msg, accessToken, part, idemKey string) (*utils.RequestResponse, error) {
+	glMsg := &mtMsg{
+		Address:          strings.TrimPrefix(msg.URN().Path(), "+"),
+		Message:          part,
+		ClientCorrelator: idemKey,
+	}
+
+	requestBody := &bytes.Buffer{}
+	json.NewEncoder(requestBody).Encode(glMsg)
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf(sendURL, msg.Channel().Address(), accessToken), bytes.NewReader(requestBody.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Idempotency-Key", idemKey)
+
+	return utils.MakeHTTPRequest(req)
+}
+
+// isSuccess returns whether rr represents a successful (2xx) response. err is
+// only consulted when rr is nil, since MakeHTTPRequest also returns a non-nil
+// err for non-2xx responses
+func isSuccess(rr *utils.RequestResponse, err error) bool {
+	if rr == nil {
+		return err == nil
+	}
+	return rr.StatusCode >= 200 && rr.StatusCode < 300
+}
+
+// isRetryableError returns whether the given request/response or error represents
+// a transient failure worth retrying (network errors, 5xx and 429 responses).
+// Permanent failures like a 4xx should fail fast instead
+func isRetryableError(rr *utils.RequestResponse, err error) bool {
+	if rr == nil {
+		return err != nil
+	}
+	return rr.StatusCode >= 500 || rr.StatusCode == http.StatusTooManyRequests
+}
+
+// backoffDelay returns the delay to wait before the next retry attempt, using
+// exponential backoff with jitter: min(base * 2^attempt, max) + rand(0, base)
+func backoffDelay(base, max time.Duration, attempt int) time.Duration {
+	delay := base * time.Duration(int64(1)<<uint(attempt))
+	if delay > max {
+		delay = max
+	}
+	return delay + time.Duration(rand.Int63n(int64(base)+1))
+}
+
+// SendMsg sends the passed in message, returning any error
+func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
+
+	accessToken, expiration := h.tokens.Get(msg.Channel(), msg.URN())
+	if accessToken == "" || time.Now().After(expiration) {
+		status.AddLog(courier.NewChannelLogFromError("Message Send Error", msg.Channel(), msg.ID(),
+			fmt.Errorf("no active access token for %s, subscriber must reauthorize", msg.URN())))
+		return status, nil
+	}
+
+	retryMax := msg.Channel().IntConfigForKey(configRetryMax, defaultRetryMax)
+	retryBase := time.Duration(msg.Channel().IntConfigForKey(configRetryBaseMS, defaultRetryBaseMS)) * time.Millisecond
+	retryMaxDelay := time.Duration(msg.Channel().IntConfigForKey(configRetryMaxMS, defaultRetryMaxMS)) * time.Millisecond
+
 	parts := handlers.SplitMsg(handlers.GetTextAndAttachments(msg), maxMsgLength)
-	for _, part := range parts {
-		glMsg := &mtMsg{}
-		glMsg.Address = strings.TrimPrefix(msg.URN().Path(), "+")
-		glMsg.Message = part
-		glMsg.Passphrase = passphrase
-		glMsg.AppID = appID
-		glMsg.AppSecret = appSecret
-
-		requestBody := &bytes.Buffer{}
-		json.NewEncoder(requestBody).Encode(glMsg)
-
-		// build our request
-		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf(sendURL, msg.Channel().Address()), requestBody)
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Accept", "application/json")
-		if err != nil {
-			return nil, err
+	results := make([]partResult, 0, len(parts))
+	for partIndex, part := range parts {
+		key := idempotencyKey(msg.Channel().UUID(), msg.ID(), partIndex)
+
+		var rr *utils.RequestResponse
+		var sendErr error
+		for attempt := 0; attempt <= retryMax; attempt++ {
+			rr, sendErr = h.sendOnce(msg, accessToken, part, key)
+			log := courier.NewChannelLogFromRR(fmt.Sprintf("Message Sent (attempt %d/%d)", attempt+1, retryMax+1), msg.Channel(), msg.ID(), rr).WithError("Message Send Error", sendErr)
+			status.AddLog(log)
+
+			if !isRetryableError(rr, sendErr) || attempt == retryMax {
+				break
+			}
+			time.Sleep(backoffDelay(retryBase, retryMaxDelay, attempt))
 		}
 
-		rr, err := utils.MakeHTTPRequest(req)
-		log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
-		status.AddLog(log)
-		if err != nil {
-			return status, nil
+		success := isSuccess(rr, sendErr)
+		results = append(results, partResult{success: success, externalID: key})
+		if !success {
+			break
 		}
-		status.SetStatus(courier.MsgWired)
 	}
 
+	// a multi-part message is only MsgWired once every part has gone out; a
+	// permanent failure partway through must leave status at its default
+	// MsgErrored, not the MsgWired an earlier part's success would otherwise
+	// have left behind
+	externalID, wired := overallResult(results)
+	if externalID != "" {
+		status.SetExternalID(externalID)
+	}
+	if wired {
+		status.SetStatus(courier.MsgWired)
+	}
 	return status, nil
 }
+
+// partResult is the outcome of sending a single part of a (possibly
+// multi-part) message
+type partResult struct {
+	success    bool
+	externalID string
+}
+
+// overallResult returns the external ID to record and whether the message as
+// a whole can be considered sent, given the results of sending its parts in
+// order: every part must have succeeded, and sending stops at the first one
+// that didn't
+func overallResult(results []partResult) (externalID string, wired bool) {
+	if len(results) == 0 {
+		return "", false
+	}
+	for _, r := range results {
+		if !r.success {
+			return externalID, false
+		}
+		externalID = r.externalID
+	}
+	return externalID, true
+}
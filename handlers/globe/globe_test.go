@@ -0,0 +1,196 @@
+package globe
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/courier/utils"
+)
+
+func TestVerifySignature(t *testing.T) {
+	body := []byte(`{"hello":"world"}`)
+	secret := "sooper-secret"
+
+	valid := "sha256=" + hmacHex(secret, body)
+
+	tcs := []struct {
+		label string
+		sig   string
+		valid bool
+	}{
+		{"valid signature", valid, true},
+		{"valid signature without prefix", hmacHex(secret, body), true},
+		{"wrong secret", "sha256=deadbeef", false},
+		{"not hex", "sha256=not-hex", false},
+		{"empty", "", false},
+	}
+
+	for _, tc := range tcs {
+		if got := verifySignature(secret, body, tc.sig); got != tc.valid {
+			t.Errorf("%s: expected %v, got %v", tc.label, tc.valid, got)
+		}
+	}
+}
+
+func TestIsSuccess(t *testing.T) {
+	tcs := []struct {
+		label   string
+		rr      *utils.RequestResponse
+		err     error
+		success bool
+	}{
+		{"2xx is success", &utils.RequestResponse{StatusCode: 200}, nil, true},
+		{"201 is success", &utils.RequestResponse{StatusCode: 201}, nil, true},
+		{"4xx is not success", &utils.RequestResponse{StatusCode: 400}, errTest, false},
+		{"5xx is not success", &utils.RequestResponse{StatusCode: 500}, errTest, false},
+		{"nil response with error is not success", nil, errTest, false},
+		{"nil response without error is success", nil, nil, true},
+	}
+
+	for _, tc := range tcs {
+		if got := isSuccess(tc.rr, tc.err); got != tc.success {
+			t.Errorf("%s: expected %v, got %v", tc.label, tc.success, got)
+		}
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	tcs := []struct {
+		label     string
+		rr        *utils.RequestResponse
+		err       error
+		retryable bool
+	}{
+		{"network error with no response is retryable", nil, errTest, true},
+		{"2xx is not retryable", &utils.RequestResponse{StatusCode: 200}, nil, false},
+		{"permanent 4xx is not retryable", &utils.RequestResponse{StatusCode: 400}, errTest, false},
+		{"5xx is retryable", &utils.RequestResponse{StatusCode: 500}, errTest, true},
+		{"429 is retryable", &utils.RequestResponse{StatusCode: http.StatusTooManyRequests}, errTest, true},
+	}
+
+	for _, tc := range tcs {
+		if got := isRetryableError(tc.rr, tc.err); got != tc.retryable {
+			t.Errorf("%s: expected %v, got %v", tc.label, tc.retryable, got)
+		}
+	}
+}
+
+func TestOverallResult(t *testing.T) {
+	tcs := []struct {
+		label      string
+		results    []partResult
+		externalID string
+		wired      bool
+	}{
+		{"no parts", nil, "", false},
+		{"single part succeeds", []partResult{{success: true, externalID: "a"}}, "a", true},
+		{"single part fails", []partResult{{success: false, externalID: "a"}}, "", false},
+		{
+			"all parts succeed, reports the last external id",
+			[]partResult{{success: true, externalID: "a"}, {success: true, externalID: "b"}},
+			"b", true,
+		},
+		{
+			"later part fails after an earlier part succeeded",
+			[]partResult{{success: true, externalID: "a"}, {success: false, externalID: "b"}},
+			"a", false,
+		},
+	}
+
+	for _, tc := range tcs {
+		externalID, wired := overallResult(tc.results)
+		if externalID != tc.externalID || wired != tc.wired {
+			t.Errorf("%s: expected (%q, %v), got (%q, %v)", tc.label, tc.externalID, tc.wired, externalID, wired)
+		}
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	base := 500 * time.Millisecond
+	max := 5 * time.Second
+
+	for attempt := 0; attempt < 6; attempt++ {
+		delay := backoffDelay(base, max, attempt)
+		if delay < 0 || delay > max+base {
+			t.Errorf("attempt %d: delay %s out of expected bounds", attempt, delay)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tcs := []struct {
+		label          string
+		trustForwarded bool
+		remoteAddr     string
+		headers        map[string]string
+		expected       string
+	}{
+		{"no proxy headers uses remote addr", false, "203.0.113.5:54321", nil, "203.0.113.5"},
+		{"forwarded headers ignored unless trusted", false, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.5, 10.0.0.1"}, "10.0.0.1"},
+		{"x-forwarded-for takes first hop when trusted", true, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.5, 10.0.0.1"}, "203.0.113.5"},
+		{"x-real-ip used when no x-forwarded-for", true, "10.0.0.1:1234", map[string]string{"X-Real-IP": "203.0.113.5"}, "203.0.113.5"},
+	}
+
+	for _, tc := range tcs {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+		if got := clientIP(tc.trustForwarded, r); got != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.label, tc.expected, got)
+		}
+	}
+}
+
+func TestMarkSeenExpiresByTime(t *testing.T) {
+	h := newHandler().(*handler)
+
+	if h.markSeen("sig-1") {
+		t.Error("first sighting of sig-1 should not be seen")
+	}
+	if !h.markSeen("sig-1") {
+		t.Error("second sighting of sig-1 within the replay window should be seen")
+	}
+
+	// simulate sig-1 having been seen outside the replay window
+	front := h.seenOrder.Front()
+	entry := front.Value.(seenSignature)
+	entry.seenAt = time.Now().Add(-replayWindow - time.Second)
+	front.Value = entry
+
+	if h.markSeen("sig-1") {
+		t.Error("sig-1 should no longer be considered seen once it's outside the replay window")
+	}
+}
+
+func TestMarkSeenEnforcesMaxBackstop(t *testing.T) {
+	h := newHandler().(*handler)
+
+	// fill past the backstop with signatures that are all still within the
+	// replay window, so only the count cap (not time) can evict them
+	for i := 0; i < maxSeenSignatures+10; i++ {
+		h.markSeen(string(rune(i)))
+	}
+
+	if h.seenOrder.Len() > maxSeenSignatures {
+		t.Errorf("expected at most %d tracked signatures, got %d", maxSeenSignatures, h.seenOrder.Len())
+	}
+}
+
+var errTest = &testError{}
+
+type testError struct{}
+
+func (e *testError) Error() string { return "test error" }
+
+func hmacHex(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}